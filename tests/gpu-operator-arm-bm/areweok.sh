@@ -7,11 +7,283 @@ SCRIPT_DIR=$( cd -- "$( dirname -- "${BASH_SOURCE[0]}" )" &> /dev/null && pwd )
 cd ${SCRIPT_DIR}
 . ${SCRIPT_DIR}/config.sh
 
-status=$(${oc_command} get clusterpolicy gpu-cluster-policy -o yaml | yq '.status.state')
+restarted_operands() {
+    ${oc_command} get pods -n ${namespace} -o json | jq -r '.items[] | select(any(.status.containerStatuses[]?; .restartCount > 0)) | .metadata.name'
+}
 
-${oc_command} wait --for=condition=ready pod -l app=nvidia-dcgm  --timeout=5m
+# follow every operand pod once it has restarted, so the next crash is captured as it happens
+stream_restarted_operands() {
+    trap 'kill $(jobs -p) 2> /dev/null' EXIT
+    while true; do
+        for pod in $(restarted_operands); do
+            if [ ! -e ${artifact_dir}/${pod}.log ]; then
+                ${oc_command} logs -f -n ${namespace} ${pod} --all-containers --prefix > ${artifact_dir}/${pod}.log 2>&1 &
+            fi
+        done
+        sleep 30 &
+        wait $!
+    done
+}
 
-if [ "${status}" != "ready" ]; then
-    echo "GPU Operator not ready"
+collect_logs() {
+    kill ${operator_log_pid} ${operand_log_pid} 2> /dev/null || true
+    # the previous container logs of restarted operands are gone once the job times out
+    for pod in $(restarted_operands); do
+        ${oc_command} logs -n ${namespace} ${pod} --all-containers --previous > ${artifact_dir}/${pod}-previous.log 2>&1 || true
+    done
+}
+
+# record exactly which build was tested, down to the digests the operand pods actually run
+write_versions() {
+    subscription=$(${oc_command} get subscriptions.operators.coreos.com -n ${namespace} -o json | jq '.items[] | select(.spec.name == "gpu-operator-certified")')
+    subscription=${subscription:-null}
+    installed_csv=$(jq -r '.status.installedCSV // empty' <<< "${subscription}")
+    csv_json=null
+    if [ -n "${installed_csv}" ]; then
+        csv_json=$(${oc_command} get csv -n ${namespace} ${installed_csv} -o json)
+        csv_json=${csv_json:-null}
+    fi
+    # OLM drops the bundle lookups once the bundle is unpacked, and the configured bundle is only
+    # what gets installed outside the stable channel; tags float, so only digests are recorded
+    installplan=$(jq -r '.status.installPlanRef.name // empty' <<< "${subscription}")
+    bundle_image=""
+    if [ -n "${installplan}" ]; then
+        bundle_image=$(${oc_command} get installplan -n ${namespace} ${installplan} -o json | jq -r '.status.bundleLookups[0].path // empty')
+    fi
+    if [ -z "${bundle_image}" ] && [ "${channel}" != "stable" ]; then
+        bundle_image=${bundle}
+    fi
+    if [ -n "${bundle_image}" ] && [[ "${bundle_image}" != *@* ]]; then
+        bundle_repository=${bundle_image}
+        if [[ "${bundle_image##*/}" == *:* ]]; then
+            bundle_repository=${bundle_image%:*}
+        fi
+        bundle_digest=$(${oc_command} image info -o json "${bundle_image}" | jq -r '.digest // empty')
+        bundle_image=""
+        if [ -n "${bundle_digest}" ]; then
+            bundle_image="${bundle_repository}@${bundle_digest}"
+        fi
+    fi
+    # the index the catalog pod actually runs, the CatalogSource itself only names a floating tag
+    catalog_image=""
+    if [ "${subscription}" != "null" ]; then
+        catalog_image=$(${oc_command} get pods -n $(jq -r '.spec.sourceNamespace' <<< "${subscription}") -l olm.catalogSource=$(jq -r '.spec.source' <<< "${subscription}") -o json | jq -r '[.items[].status.containerStatuses[]?.imageID | select(. != "")][0] // empty')
+    fi
+    operands=$(${oc_command} get pods -n ${namespace} -o json | jq '[.items[].status.containerStatuses[]? | {image, imageID}] | unique')
+    # the versions the driver actually loaded on each node, a wedged driver must not hang the exit handler
+    drivers='[]'
+    for pod in $(${oc_command} get pods -n ${namespace} -l app.kubernetes.io/component=nvidia-driver -o jsonpath='{.items[*].metadata.name}'); do
+        smi=$(timeout 60 ${oc_command} exec -n ${namespace} ${pod} -c nvidia-driver-ctr -- nvidia-smi) || continue
+        loaded_driver=$(timeout 60 ${oc_command} exec -n ${namespace} ${pod} -c nvidia-driver-ctr -- nvidia-smi --query-gpu=driver_version --format=csv,noheader | head -n 1)
+        cuda_version=$(sed -n 's/.*CUDA Version: *\([0-9.]*\).*/\1/p' <<< "${smi}")
+        node=$(${oc_command} get pod -n ${namespace} ${pod} -o jsonpath='{.spec.nodeName}')
+        drivers=$(jq -c --arg node "${node}" --arg driver "${loaded_driver}" --arg cuda "${cuda_version}" '. + [{node: $node, driverVersion: $driver, cudaVersion: $cuda}]' <<< "${drivers}")
+    done
+    jq -n \
+        --argjson subscription "${subscription}" \
+        --argjson csv "${csv_json}" \
+        --argjson operands "${operands:-[]}" \
+        --argjson drivers "${drivers}" \
+        --arg bundle "${bundle_image}" \
+        --arg catalogImage "${catalog_image}" \
+        '{
+            csv: $csv.metadata.name,
+            version: $csv.spec.version,
+            channel: $subscription.spec.channel,
+            catalogSource: $subscription.spec.source,
+            catalogImage: (if $catalogImage == "" then null else $catalogImage end),
+            bundle: (if $bundle == "" then null else $bundle end),
+            operands: $operands,
+            drivers: $drivers
+        }' > ${artifact_dir}/versions.json
+}
+
+# runs on every exit, the artifacts must not turn a passed check into a failure
+finish() {
+    exit_status=$?
+    set +e
+    collect_logs
+    write_versions
+    exit ${exit_status}
+}
+
+# stream the operator log while waiting so a timeout leaves the full history behind
+${oc_command} logs -f -n ${namespace} deployment/gpu-operator > ${artifact_dir}/gpu-operator.log 2>&1 &
+operator_log_pid=$!
+stream_restarted_operands &
+operand_log_pid=$!
+trap finish EXIT
+
+operand_status() {
+    ${oc_command} get daemonsets -n ${namespace} -o json | jq -r '.items[] | "\(.metadata.name) \(.status.numberReady)/\(.status.desiredNumberScheduled) ready"'
+}
+
+driver_unhealthy() {
+    ${oc_command} get pods -n ${namespace} -l app.kubernetes.io/component=nvidia-driver -o json | jq -e 'any(.items[].status.containerStatuses[]?; .ready == false or .restartCount > 0)' > /dev/null
+}
+
+# the first thing the driver team asks for when a CI failure is escalated
+collect_bug_report() {
+    for pod in $(${oc_command} get pods -n ${namespace} -l app.kubernetes.io/component=nvidia-driver -o jsonpath='{.items[*].metadata.name}'); do
+        # a wedged driver can block the nvidia-smi calls inside the script, which must not hang the job
+        timeout 300 ${oc_command} exec -n ${namespace} ${pod} -c nvidia-driver-ctr -- nvidia-bug-report.sh --safe-mode --output-file /tmp/nvidia-bug-report.log || continue
+        ${oc_command} cp -n ${namespace} -c nvidia-driver-ctr ${pod}:/tmp/nvidia-bug-report.log.gz ${artifact_dir}/${pod}-nvidia-bug-report.log.gz || true
+    done
+}
+
+not_ready() {
+    echo "GPU Operator not ready: ${1}"
+    ${oc_command} get clusterpolicy gpu-cluster-policy -o json | jq '.status'
+    operand_status
+    if [[ "${1}" == *driver* ]] || driver_unhealthy; then
+        collect_bug_report
+    fi
     exit -2
+}
+
+# daemonsets the operator is expected to roll out for the components enabled in the ClusterPolicy
+expected_daemonsets() {
+    ${oc_command} get clusterpolicy gpu-cluster-policy -o json | jq -r '
+        {
+            "driver": "nvidia-driver-daemonset",
+            "toolkit": "nvidia-container-toolkit-daemonset",
+            "devicePlugin": "nvidia-device-plugin-daemonset",
+            "dcgm": "nvidia-dcgm",
+            "dcgmExporter": "nvidia-dcgm-exporter",
+            "gfd": "gpu-feature-discovery",
+            "migManager": "nvidia-mig-manager",
+            "validator": "nvidia-operator-validator",
+            "nodeStatusExporter": "nvidia-node-status-exporter"
+        } as $daemonsets
+        | .spec | to_entries[]
+        | select($daemonsets[.key] != null)
+        # node status exporter is the only one of these disabled unless requested
+        | select(.value.enabled == true or (.value.enabled == null and .key != "nodeStatusExporter"))
+        | $daemonsets[.key]'
+}
+
+# with the driver toolkit the driver daemonset name carries the RHCOS version, find it by its component label
+resolve_daemonsets() {
+    if [ "${1}" = "nvidia-driver-daemonset" ]; then
+        ${oc_command} get daemonsets -n ${namespace} -l app.kubernetes.io/component=nvidia-driver -o jsonpath='{.items[*].metadata.name}'
+    else
+        ${oc_command} get daemonset -n ${namespace} ${1} -o jsonpath='{.metadata.name}' 2> /dev/null || true
+    fi
+}
+
+# the driver daemonset uses the OnDelete strategy, which has no rollout status, so compare the counters
+daemonset_ready() {
+    ${oc_command} get daemonset -n ${namespace} ${1} -o json | jq -e '
+        .status.observedGeneration == .metadata.generation
+        and .status.numberReady == .status.desiredNumberScheduled
+        and (.status.numberUnavailable // 0) == 0' > /dev/null
+}
+
+# the operator creates the daemonsets one state at a time, so they may not all exist yet;
+# a single deadline bounds both their creation and their readiness
+daemonset_deadline=$((SECONDS + ${wait_timeout%m} * 60))
+for daemonset in $(expected_daemonsets); do
+    interval=5
+    until resolved=$(resolve_daemonsets ${daemonset}) && [ -n "${resolved}" ]; do
+        if [ ${SECONDS} -ge ${daemonset_deadline} ]; then
+            not_ready "daemonset ${daemonset} was not created"
+        fi
+        backoff
+    done
+    for name in ${resolved}; do
+        interval=5
+        until daemonset_ready ${name}; do
+            if [ ${SECONDS} -ge ${daemonset_deadline} ]; then
+                not_ready "daemonset ${name} did not become ready"
+            fi
+            backoff
+        done
+    done
+done
+
+${oc_command} wait --for=condition=ready pod -n ${namespace} -l app=nvidia-dcgm  --timeout=${wait_timeout} || not_ready "dcgm pods did not become ready"
+
+status=$(${oc_command} get clusterpolicy gpu-cluster-policy -o yaml | yq '.status.state')
+
+if [ "${status}" != "ready" ]; then
+    not_ready "ClusterPolicy state is ${status}"
+fi
+
+# operands that did not roll after an operator change keep images the CSV no longer references;
+# the driver image gets an OS suffixed tag and the driver toolkit image comes from an imagestream at runtime
+csv=$(${oc_command} get subscriptions.operators.coreos.com -n ${namespace} -o json | jq -r '.items[] | select(.spec.name == "gpu-operator-certified") | .status.installedCSV')
+related_images=$(${oc_command} get csv -n ${namespace} ${csv} -o json | jq -r '.spec.relatedImages[]?.image')
+operand_images=$(${oc_command} get daemonsets,deployments -n ${namespace} -o json | jq -r '
+    .items[].spec.template.spec | (.containers + (.initContainers // []))[]
+    | select(.name != "nvidia-driver-ctr" and .name != "openshift-driver-toolkit-ctr")
+    | .image' | sort -u)
+stale_images=""
+for image in ${operand_images}; do
+    if ! grep -qxF "${image}" <<< "${related_images}"; then
+        stale_images="${stale_images} ${image}"
+    fi
+done
+if [ -n "${stale_images}" ]; then
+    not_ready "operand images not listed in the relatedImages of ${csv}:${stale_images}"
+fi
+
+# monitoring wiring: the operator always exposes its metrics, the dcgm exporter ServiceMonitor is opt-in
+monitoring_objects="service/gpu-operator servicemonitors.monitoring.coreos.com/gpu-operator"
+scraped_services="gpu-operator"
+dcgm_exporter=$(${oc_command} get clusterpolicy gpu-cluster-policy -o json | jq -c '.spec.dcgmExporter // {}')
+if [ "$(jq -r '.enabled' <<< "${dcgm_exporter}")" != "false" ]; then
+    monitoring_objects="${monitoring_objects} service/nvidia-dcgm-exporter"
+    if [ "$(jq -r '.serviceMonitor.enabled' <<< "${dcgm_exporter}")" = "true" ]; then
+        monitoring_objects="${monitoring_objects} servicemonitors.monitoring.coreos.com/nvidia-dcgm-exporter"
+        scraped_services="${scraped_services} nvidia-dcgm-exporter"
+    fi
+fi
+missing_monitoring=""
+for object in ${monitoring_objects}; do
+    ${oc_command} get -n ${namespace} ${object} > /dev/null 2>&1 || missing_monitoring="${missing_monitoring} ${object}"
+done
+if [ -n "${missing_monitoring}" ]; then
+    not_ready "missing monitoring objects:${missing_monitoring}"
+fi
+
+prometheus_api() {
+    ${oc_command} exec -n openshift-monitoring prometheus-k8s-0 -c prometheus -- curl -sG "http://localhost:9090/api/v1/${1}" "${@:2}"
+}
+
+# services with a ServiceMonitor that have no healthy target in the platform Prometheus
+down_targets() {
+    targets=$(prometheus_api targets --data-urlencode state=active) && [ -n "${targets}" ] || return 1
+    jq -r --arg namespace "${namespace}" --arg services "${scraped_services}" '
+        [.data.activeTargets[] | select(.labels.namespace == $namespace)] as $targets
+        | $services | split(" ")[]
+        | select(. as $service | $targets | any(.labels.service == $service and .health == "up") | not)' <<< "${targets}"
+}
+
+dcgm_samples() {
+    prometheus_api query --data-urlencode "query=DCGM_FI_DEV_GPU_UTIL{namespace=\"${namespace}\"}" | jq -e '.data.result | length > 0' > /dev/null
+}
+
+# new targets only show up after Prometheus reloads its configuration and scrapes them once
+monitoring_deadline=$((SECONDS + ${wait_timeout%m} * 60))
+interval=5
+until down=$(down_targets) && [ -z "${down}" ]; do
+    if [ ${SECONDS} -ge ${monitoring_deadline} ]; then
+        not_ready "Prometheus targets not up: ${down:-unknown, query failed}"
+    fi
+    backoff
+done
+if [[ " ${scraped_services} " == *" nvidia-dcgm-exporter "* ]]; then
+    interval=5
+    until dcgm_samples; do
+        if [ ${SECONDS} -ge ${monitoring_deadline} ]; then
+            not_ready "Prometheus returned no DCGM_FI_DEV_GPU_UTIL samples"
+        fi
+        backoff
+    done
+fi
+
+# the driver and device plugin must survive node memory pressure, which requires the operator to mark them critical
+not_critical=$(${oc_command} get daemonsets -n ${namespace} -o json | jq -r '.items[] | select(.metadata.name | test("^nvidia-(driver|device-plugin)-daemonset")) | select(.spec.template.spec.priorityClassName != "system-node-critical") | .metadata.name')
+if [ -n "${not_critical}" ]; then
+    not_ready "operands not system-node-critical: ${not_critical}"
 fi
@@ -0,0 +1,20 @@
+#!/bin/bash
+
+set -e
+set -x
+
+SCRIPT_DIR=$( cd -- "$( dirname -- "${BASH_SOURCE[0]}" )" &> /dev/null && pwd )
+cd ${SCRIPT_DIR}
+. ${SCRIPT_DIR}/config.sh
+
+# the CRD schema only allows the single and mixed MIG strategies, anything else must be rejected by the API server
+invalid_policy=$(${oc_command} get clusterpolicy gpu-cluster-policy -o json | jq '{apiVersion, kind, metadata: {name: .metadata.name}, spec: (.spec | .mig.strategy = "invalid")}')
+if output=$(${oc_command} apply --dry-run=server -f - <<< "${invalid_policy}" 2>&1); then
+    echo "ClusterPolicy with an invalid mig.strategy was accepted"
+    exit -1
+fi
+echo "${output}"
+if ! grep -q "spec.mig.strategy" <<< "${output}"; then
+    echo "ClusterPolicy with an invalid mig.strategy was rejected without naming the field"
+    exit -1
+fi
@@ -5,12 +5,41 @@ set -x
 
 config_file=config.json
 
-bundle=$(cat ${config_file} | jq -r '.bundle_url')
-driver=$(cat ${config_file} | jq -r '.driver_image')
+bundle=$(cat ${config_file} | jq -r '.bundle')
+driver_repository=$(cat ${config_file} | jq -r '.driver_repository // empty')
+driver_image=$(cat ${config_file} | jq -r '.driver_image // empty')
+driver_version=$(cat ${config_file} | jq -r '.driver_version // empty')
+driver_pull_secret=$(cat ${config_file} | jq -r '.driver_pull_secret // empty')
+# the operator builds the driver image as repository/image:version, a partial override is not a valid image
+if [ -n "${driver_repository}${driver_image}${driver_version}" ] && { [ -z "${driver_repository}" ] || [ -z "${driver_image}" ] || [ -z "${driver_version}" ]; }; then
+    echo "driver_repository, driver_image and driver_version must be set together"
+    exit -1
+fi
 channel=$(cat ${config_file} | jq -r '.channel')
+namespace=$(cat ${config_file} | jq -r '.namespace // "nvidia-gpu-operator"')
+install_mode=$(cat ${config_file} | jq -r '.install_mode // "OwnNamespace"')
+target_namespaces=$(cat ${config_file} | jq -c '.target_namespaces // []')
+validate_images=$(cat ${config_file} | jq -r '.validate_images // false')
+subscription_config=$(cat ${config_file} | jq -c '.subscription_config // {}')
 
 oc_command="oc --insecure-skip-tls-verify --kubeconfig /var/run/secrets/armsnokubeconfig"
 
+artifact_dir=${ARTIFACT_DIR:-/tmp/artifacts}
+mkdir -p ${artifact_dir}
+
+# on single-node OpenShift the driver build and all operands share one node, give them more time
+topology=$(${oc_command} get infrastructure cluster -o jsonpath='{.status.controlPlaneTopology}')
+wait_timeout=5m
+if [ "${topology}" = "SingleReplica" ]; then
+    wait_timeout=10m
+fi
+
+# exponential backoff with jitter for polling loops, up to a minute plus jitter; callers reset ${interval}
+backoff() {
+    sleep $((interval + RANDOM % interval))
+    interval=$((interval * 2 > 60 ? 60 : interval * 2))
+}
+
 ls -lah /var/run/secrets
 cp /var/run/secrets/version /tmp/secver
 cat /tmp/secver
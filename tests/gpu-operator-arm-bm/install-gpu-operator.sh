@@ -6,25 +6,116 @@ cd ${SCRIPT_DIR}
 set -e
 set -x
 
+# namespaces the operator watches, and the matching operator-sdk --install-mode value
+case "${install_mode}" in
+    OwnNamespace)
+        target_namespaces=$(jq -cn --arg namespace "${namespace}" '[$namespace]')
+        sdk_install_mode=${install_mode}
+        ;;
+    SingleNamespace|MultiNamespace)
+        count=$(jq length <<< "${target_namespaces}")
+        if [ ${count} -eq 0 ] || { [ "${install_mode}" = "SingleNamespace" ] && [ ${count} -ne 1 ]; }; then
+            echo "install_mode ${install_mode} does not match target_namespaces ${target_namespaces}"
+            exit -1
+        fi
+        sdk_install_mode="${install_mode}=$(jq -r 'join(",")' <<< "${target_namespaces}")"
+        ;;
+    AllNamespaces)
+        target_namespaces='[]'
+        sdk_install_mode=${install_mode}
+        ;;
+    *)
+        echo "Unsupported install_mode: ${install_mode}"
+        exit -1
+        ;;
+esac
+
+${oc_command} create namespace ${namespace} --dry-run=client -o yaml | ${oc_command} apply -f -
+# the platform Prometheus only scrapes the operator and dcgm exporter in namespaces opted into cluster monitoring
+${oc_command} label namespace ${namespace} openshift.io/cluster-monitoring=true --overwrite
+
 if [ "${channel}" = "stable" ]; then
     #todo: better differentiate between types of deployments (catalogsource bundle, marketplace etc)
     currentCSV=$(${oc_command} get packagemanifests/gpu-operator-certified -n openshift-marketplace -ojson | jq -r '.status.channels[] | select(.name == "stable") | .currentCSV')
-    cp subscription.yaml _subscription.yaml
+    if [ "${validate_images}" = "true" ]; then
+        # fail in seconds on a disconnected cluster instead of waiting for the operands to time out
+        pull_secret=$(mktemp)
+        mirrors=$(mktemp)
+        trap "rm -f ${pull_secret} ${mirrors}" EXIT
+        ${oc_command} extract secret/pull-secret -n openshift-config --keys=.dockerconfigjson --to=- > ${pull_secret}
+        # resolve through the cluster's mirrors, the way its nodes pull, not the registries this pod happens to reach
+        mirror_flags=""
+        ${oc_command} get imagedigestmirrorsets -o json 2> /dev/null | jq -c 'select(.items | length > 0) | {
+            apiVersion: "config.openshift.io/v1",
+            kind: "ImageDigestMirrorSet",
+            metadata: {name: "cluster-mirrors"},
+            spec: {imageDigestMirrors: [.items[].spec.imageDigestMirrors[]?]}
+        }' > ${mirrors}
+        if [ -s ${mirrors} ]; then
+            mirror_flags="--idms-file=${mirrors}"
+        else
+            ${oc_command} get imagecontentsourcepolicies -o json 2> /dev/null | jq -c 'select(.items | length > 0) | {
+                apiVersion: "operator.openshift.io/v1alpha1",
+                kind: "ImageContentSourcePolicy",
+                metadata: {name: "cluster-mirrors"},
+                spec: {repositoryDigestMirrors: [.items[].spec.repositoryDigestMirrors[]?]}
+            }' > ${mirrors}
+            if [ -s ${mirrors} ]; then
+                mirror_flags="--icsp-file=${mirrors}"
+            fi
+        fi
+        unpullable=""
+        for image in $(${oc_command} get packagemanifests/gpu-operator-certified -n openshift-marketplace -ojson | jq -r '.status.channels[] | select(.name == "stable") | .currentCSVDesc.relatedImages[]?'); do
+            ${oc_command} image info --filter-by-os=linux/arm64 -a ${pull_secret} ${mirror_flags} "${image}" > /dev/null || unpullable="${unpullable} ${image}"
+        done
+        rm -f ${pull_secret} ${mirrors}
+        if [ -n "${unpullable}" ]; then
+            echo "Images of ${currentCSV} cannot be pulled:${unpullable}"
+            exit -1
+        fi
+    fi
+    sed "s/nvidia-gpu-operator$/${namespace}/" subscription.yaml > _subscription.yaml
+    sed "s/nvidia-gpu-operator$/${namespace}/" operatorgroup.yaml > _operatorgroup.yaml
     echo "  startingCSV: ${currentCSV}" >> _subscription.yaml
     echo "  channel: ${channel}" >> _subscription.yaml
-    ${oc_command} apply -f operatorgroup.yaml
-    ${oc_command} apply -f _subscription.yaml
+    # an OperatorGroup without targetNamespaces selects every namespace
+    ${oc_command} apply -f _operatorgroup.yaml --dry-run=client -o json | \
+        jq --argjson targets "${target_namespaces}" 'if $targets == [] then del(.spec.targetNamespaces) else .spec.targetNamespaces = $targets end' | \
+        ${oc_command} apply -f -
+    # env, nodeSelector, tolerations and resources for the operator controller pod
+    ${oc_command} apply -f _subscription.yaml --dry-run=client -o json | jq --argjson config "${subscription_config}" '.spec.config = $config' | ${oc_command} apply -f -
 else
-    operator-sdk run bundle --kubeconfig /var/run/secrets/armsnokubeconfig--timeout=1m -n nvidia-gpu-operator --install-mode OwnNamespace "${bundle}"
+    operator-sdk run bundle --kubeconfig /var/run/secrets/armsnokubeconfig --timeout=1m -n ${namespace} --install-mode ${sdk_install_mode} "${bundle}"
 fi
 
 #todo: write a proper wait for the correct resource
 sleep 60
-${oc_command} wait --for=condition=ready pod -l app=gpu-operator --timeout=5m
+${oc_command} wait --for=condition=ready pod -n ${namespace} -l app=gpu-operator --timeout=${wait_timeout}
 
-while [ "$(${oc_command} get -n nvidia-gpu-operator ClusterServiceVersion ${currentCSV} -o json | jq -r '.status.phase')" != "Succeeded" ]; do sleep 10; done
+# back off to go easy on the API server while OLM reconciles
+interval=5
+csv_deadline=$((SECONDS + 15 * 60))
+while true; do
+    # follow the subscription, the CSV is replaced (and briefly missing) when OLM upgrades it
+    subscriptionCSV=$(${oc_command} get subscriptions.operators.coreos.com -n ${namespace} -o json | jq -r '.items[] | select(.spec.name == "gpu-operator-certified") | .status.currentCSV // empty')
+    currentCSV=${subscriptionCSV:-${currentCSV}}
+    phase=$(${oc_command} get -n ${namespace} ClusterServiceVersion ${currentCSV} -o json 2> /dev/null | jq -r '.status.phase')
+    if [ "${phase}" = "Succeeded" ]; then
+        break
+    fi
+    if [ ${SECONDS} -ge ${csv_deadline} ]; then
+        echo "CSV ${currentCSV} did not succeed, phase: ${phase:-NotFound}"
+        exit -1
+    fi
+    backoff
+done
 
-${oc_command} get csv -n nvidia-gpu-operator "${currentCSV}" -ojsonpath={.metadata.annotations.alm-examples} | jq .[0] | ${oc_command} apply -f -
+# optionally pull the driver from a private mirror instead of the one in the CSV example
+${oc_command} get csv -n ${namespace} "${currentCSV}" -ojsonpath={.metadata.annotations.alm-examples} | jq .[0] | \
+    jq --arg repository "${driver_repository}" --arg image "${driver_image}" --arg version "${driver_version}" --arg secret "${driver_pull_secret}" '
+        if $repository != "" then .spec.driver += {repository: $repository, image: $image, version: $version} else . end
+        | if $secret != "" then .spec.driver.imagePullSecrets = [$secret] else . end' | \
+    ${oc_command} apply -f -
 
 #todo: proper wait
 sleep 60
@@ -7,21 +7,18 @@ SCRIPT_DIR=$( cd -- "$( dirname -- "${BASH_SOURCE[0]}" )" &> /dev/null && pwd )
 cd ${SCRIPT_DIR}
 . ${SCRIPT_DIR}/config.sh
 
-subscription="$(${oc_command} get subscriptions.operators.coreos.com -o json | jq -r '.items[].metadata.name' | grep gpu-operator)" || exit 0
-if [ -z ${subscription} ]; then
-    echo Subscription is empty.
-    exit -1
-fi
-currentCSV=$(${oc_command} get subscriptions.operators.coreos.com ${subscription} -o json | jq -r '.status.currentCSV')
-if [ -z ${currentCSV} ]; then
-    echo CSV is empty.
-    exit -1
-fi
+# every step tolerates what an earlier, aborted uninstall already removed,
+# so the CSV is looked up on its own rather than through the subscription
+subscriptions=$(${oc_command} get subscriptions.operators.coreos.com -n ${namespace} -o json | jq -r '.items[] | select(.spec.name == "gpu-operator-certified") | .metadata.name')
+csvs=$(${oc_command} get clusterserviceversions -n ${namespace} -o json | jq -r '.items[] | select(.metadata.name | startswith("gpu-operator-certified.")) | .metadata.name')
 
-echo Subscription: ${subscription}
-echo CSV: ${currentCSV}
-
-${oc_command} delete subscription ${subscription}
-${oc_command} delete clusterserviceversion ${currentCSV}
-${oc_command} delete crd clusterpolicies.nvidia.com
+echo Subscriptions: ${subscriptions}
+echo CSVs: ${csvs}
 
+for subscription in ${subscriptions}; do
+    ${oc_command} delete subscription -n ${namespace} ${subscription} --ignore-not-found
+done
+for csv in ${csvs}; do
+    ${oc_command} delete clusterserviceversion -n ${namespace} ${csv} --ignore-not-found
+done
+${oc_command} delete crd clusterpolicies.nvidia.com --ignore-not-found